@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// initAPIServer starts the pool's HTTP API: the Prometheus metrics
+// endpoint and the PPLNS payout views.
+func initAPIServer(conf *config, db *database) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", poolMetrics)
+	mux.HandleFunc("/payouts/pending", pendingPayoutsHandler(db))
+	mux.HandleFunc("/payouts/history", payoutHistoryHandler(db))
+
+	addr := net.JoinHostPort(conf.APIServer.Address, strconv.Itoa(conf.APIServer.Port))
+	log.Warning("api server listening on ", addr)
+
+	if err := http.ListenAndServe(addr, basicAuth(conf, mux)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// basicAuth requires HTTP basic auth against conf.APIServer.AuthUser/AuthPass
+// before handing the request to next, so every route this api server
+// exposes - including /metrics and the payout views, which otherwise hand
+// out every miner's balance and history to anyone who can reach the port -
+// is protected the same way wallet.go already protects the wallet owner
+// API.
+func basicAuth(conf *config, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != conf.APIServer.AuthUser || pass != conf.APIServer.AuthPass {
+			w.Header().Set("WWW-Authenticate", `Basic realm="pool api"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// pendingPayoutsHandler lists payouts still waiting on the payout
+// scheduler to send them.
+func pendingPayoutsHandler(db *database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pending, err := db.pendingPayouts()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(pending)
+	}
+}
+
+// payoutHistoryHandler lists payouts the scheduler has already settled, for
+// the login given in the "login" query parameter.
+func payoutHistoryHandler(db *database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		login := r.URL.Query().Get("login")
+
+		history, err := db.payoutHistory(login)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(history)
+	}
+}
@@ -2,21 +2,76 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 )
 
+// NodeConfig describes a single grin-node stratum endpoint. The pool can be
+// configured with several of these for upstream failover.
+type NodeConfig struct {
+	Address     string `json:"address"`
+	APIPort     int    `json:"api_port"`
+	StratumPort int    `json:"stratum_port"`
+	AuthUser    string `json:"auth_user"`
+	AuthPass    string `json:"auth_pass"`
+	Diff        int    `json:"diff"`
+	BlockTime   int    `json:"block_time"`
+}
+
+// TLSConfig holds the certificate pair a listener should present when it
+// terminates TLS directly.
+type TLSConfig struct {
+	Enabled bool   `json:"enabled"`
+	Cert    string `json:"cert"`
+	Key     string `json:"key"`
+}
+
+// PortConfig describes one stratum listener. The pool can bind several of
+// these at once, each with its own difficulty, TLS settings and wire
+// dialect (grin-native vs NiceHash-style stratum v1).
+type PortConfig struct {
+	Host       string    `json:"host"`
+	Port       int       `json:"port"`
+	Difficulty int64     `json:"difficulty"`
+	TLS        TLSConfig `json:"tls"`
+	NiceHash   bool      `json:"nicehash"`
+}
+
+// stratumServerConfig configures the pool's stratum listeners. Ports is the
+// current schema; Address/Port are kept for back-compat with single-listener
+// configs and are folded into Ports by UnmarshalJSON when Ports is absent.
+type stratumServerConfig struct {
+	Address         string       `json:"address"`
+	Port            int          `json:"port"`
+	BackupInterval  string       `json:"backup_interval"`
+	OmitAgentStatus []string     `json:"omit_agent_status"`
+	Ports           []PortConfig `json:"ports"`
+}
+
+// UnmarshalJSON synthesizes a single PortConfig from the legacy
+// address/port keys when the config doesn't specify "ports" explicitly.
+func (s *stratumServerConfig) UnmarshalJSON(data []byte) error {
+	type alias stratumServerConfig
+	aux := &struct{ *alias }{alias: (*alias)(s)}
+
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+
+	if len(s.Ports) == 0 && (s.Address != "" || s.Port != 0) {
+		s.Ports = []PortConfig{{Host: s.Address, Port: s.Port}}
+	}
+
+	return nil
+}
+
 type config struct {
 	Log struct {
 		Level string `json:"level"`
 		File  string `json:"file"`
 	} `json:"log"`
-	StratumServer struct {
-		Address         string   `json:"address"`
-		Port            int      `json:"port"`
-		BackupInterval  string   `json:"backup_interval"`
-		OmitAgentStatus []string `json:"omit_agent_status"`
-	} `json:"stratum_server"`
-	APIServer struct {
+	StratumServer stratumServerConfig `json:"stratum_server"`
+	APIServer     struct {
 		Address  string `json:"address"`
 		Port     int    `json:"port"`
 		AuthUser string `json:"auth_user"`
@@ -28,16 +83,8 @@ type config struct {
 		Db       int    `json:"db"`
 		Password string `json:"password"`
 	} `json:"storage"`
-	Node struct {
-		Address     string `json:"address"`
-		APIPort     int    `json:"api_port"`
-		StratumPort int    `json:"stratum_port"`
-		AuthUser    string `json:"auth_user"`
-		AuthPass    string `json:"auth_pass"`
-		Diff        int    `json:"diff"`
-		BlockTime   int    `json:"block_time"`
-	} `json:"node"`
-	Wallet struct {
+	Upstreams []NodeConfig `json:"upstreams"`
+	Wallet    struct {
 		Address         string `json:"address"`
 		OwnerAPIVersion string `json:"owner_api_version"`
 		OwnerAPIPort    int    `json:"owner_api_port"`
@@ -47,7 +94,58 @@ type config struct {
 	Payer struct {
 		Time string  `json:"time"`
 		Fee  float64 `json:"fee"`
+		N    int64   `json:"n"`
 	} `json:"payer"`
+	Vardiff struct {
+		Enabled          bool    `json:"enabled"`
+		TargetTime       int64   `json:"target_time"`
+		RetargetInterval int64   `json:"retarget_interval"`
+		Variance         float64 `json:"variance"`
+		MinDiff          int64   `json:"min_diff"`
+		MaxDiff          int64   `json:"max_diff"`
+	} `json:"vardiff"`
+	Policy struct {
+		Banning struct {
+			Enabled        bool    `json:"enabled"`
+			Timeout        int64   `json:"timeout"`
+			Window         int64   `json:"window"`
+			InvalidPercent float64 `json:"invalid_percent"`
+			CheckThreshold int64   `json:"check_threshold"`
+			MalformedLimit int64   `json:"malformed_limit"`
+		} `json:"banning"`
+		Limits struct {
+			Enabled   bool  `json:"enabled"`
+			Limit     int64 `json:"limit"`
+			Grace     int64 `json:"grace"`
+			LimitJump int64 `json:"limit_jump"`
+		} `json:"limits"`
+	} `json:"policy"`
+	Events struct {
+		Webhook struct {
+			Enabled bool   `json:"enabled"`
+			URL     string `json:"url"`
+		} `json:"webhook"`
+	} `json:"events"`
+}
+
+// UnmarshalJSON accepts either the legacy single "node" key or the new
+// "upstreams" array, so existing config files keep working unchanged.
+func (c *config) UnmarshalJSON(data []byte) error {
+	type alias config
+	aux := &struct {
+		Node *NodeConfig `json:"node"`
+		*alias
+	}{alias: (*alias)(c)}
+
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+
+	if aux.Node != nil && len(c.Upstreams) == 0 {
+		c.Upstreams = []NodeConfig{*aux.Node}
+	}
+
+	return nil
 }
 
 func parseConfig() *config {
@@ -63,5 +161,9 @@ func parseConfig() *config {
 		panic(err)
 	}
 
+	if len(conf.Upstreams) == 0 {
+		panic(fmt.Errorf("config: no upstream node configured (set either \"node\" or \"upstreams\")"))
+	}
+
 	return &conf
 }
@@ -0,0 +1,72 @@
+package main
+
+import "time"
+
+// ShareAccepted is published for every share the upstream node validates.
+type ShareAccepted struct {
+	Login   string
+	Agent   string
+	Diff    int64
+	Latency time.Duration
+	Ts      time.Time
+}
+
+// ShareRejected is published whenever the upstream node returns an error
+// for a submitted share.
+type ShareRejected struct {
+	Login   string
+	Reason  string
+	Latency time.Duration
+	Ts      time.Time
+}
+
+// BlockFound is published when a miner's share solves a block.
+type BlockFound struct {
+	Hash   string
+	Height int64
+	Login  string
+	Diff   int64
+	Ts     time.Time
+}
+
+// LoginFailed is published when a miner fails to authenticate.
+type LoginFailed struct {
+	IP    string
+	Login string
+	Ts    time.Time
+}
+
+// MinerConnected is published as soon as a TCP connection is accepted.
+type MinerConnected struct {
+	IP string
+	Ts time.Time
+}
+
+// MinerDisconnected is published once a miner's connection closes.
+type MinerDisconnected struct {
+	Login string
+	IP    string
+	Ts    time.Time
+}
+
+// eventSink receives every event the pool publishes. Sinks must not block -
+// a slow sink should buffer or drop internally rather than stall the
+// stratum server.
+type eventSink interface {
+	Publish(event interface{})
+}
+
+// eventBus fans a published event out to every registered sink.
+type eventBus struct {
+	sinks []eventSink
+}
+
+func newEventBus(sinks ...eventSink) *eventBus {
+	return &eventBus{sinks: sinks}
+}
+
+func (b *eventBus) Publish(event interface{}) {
+	for _, s := range b.sinks {
+		s.Publish(event)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// latencyBuckets are the upper bounds (seconds) used for the share-submit
+// latency histogram exposed at /metrics.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// metrics aggregates the pool's Prometheus-exported counters and gauges. It
+// writes the text exposition format by hand so the pool doesn't need to
+// depend on the Prometheus client library.
+type metrics struct {
+	mu                 sync.Mutex
+	sharesTotal        map[[2]string]int64
+	minerDiff          map[string]int64
+	blocksTotal        int64
+	connected          int64
+	submitLatencyCount int64
+	submitLatencySum   float64
+	// submitLatencyBuckets[i] is the cumulative count of observations <=
+	// latencyBuckets[i], as the Prometheus histogram contract requires - it
+	// only ever grows, unlike a rolling window of raw samples.
+	submitLatencyBuckets []int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		sharesTotal:          make(map[[2]string]int64),
+		minerDiff:            make(map[string]int64),
+		submitLatencyBuckets: make([]int64, len(latencyBuckets)),
+	}
+}
+
+// poolMetrics is the process-wide metrics registry, shared by the stratum
+// server's event sink and the API server's /metrics handler.
+var poolMetrics = newMetrics()
+
+func (m *metrics) incShare(status, login string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sharesTotal[[2]string{status, login}]++
+}
+
+func (m *metrics) setDiff(login string, diff int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.minerDiff[login] = diff
+}
+
+func (m *metrics) incBlock() {
+	atomic.AddInt64(&m.blocksTotal, 1)
+}
+
+func (m *metrics) minerConnected() {
+	atomic.AddInt64(&m.connected, 1)
+}
+
+func (m *metrics) minerDisconnected() {
+	atomic.AddInt64(&m.connected, -1)
+}
+
+// observeSubmitLatency folds seconds into the cumulative histogram. Every
+// bucket whose upper bound is >= seconds is incremented, matching the
+// Prometheus convention that pool_share_submit_latency_seconds_bucket{le}
+// counts all observations <= le and therefore never decreases.
+func (m *metrics) observeSubmitLatency(seconds float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.submitLatencyCount++
+	m.submitLatencySum += seconds
+	for i, bucket := range latencyBuckets {
+		if seconds <= bucket {
+			m.submitLatencyBuckets[i]++
+		}
+	}
+}
+
+// ServeHTTP renders the current metrics in the Prometheus text exposition
+// format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP pool_shares_total Share submissions by status and login")
+	fmt.Fprintln(w, "# TYPE pool_shares_total counter")
+	for k, v := range m.sharesTotal {
+		fmt.Fprintf(w, "pool_shares_total{status=%q,login=%q} %d\n", k[0], k[1], v)
+	}
+
+	fmt.Fprintln(w, "# HELP pool_blocks_total Blocks found by the pool")
+	fmt.Fprintln(w, "# TYPE pool_blocks_total counter")
+	fmt.Fprintf(w, "pool_blocks_total %d\n", atomic.LoadInt64(&m.blocksTotal))
+
+	fmt.Fprintln(w, "# HELP pool_miner_difficulty Current difficulty assigned to each miner")
+	fmt.Fprintln(w, "# TYPE pool_miner_difficulty gauge")
+	for login, diff := range m.minerDiff {
+		fmt.Fprintf(w, "pool_miner_difficulty{login=%q} %d\n", login, diff)
+	}
+
+	fmt.Fprintln(w, "# HELP pool_connected_miners Currently connected miner sessions")
+	fmt.Fprintln(w, "# TYPE pool_connected_miners gauge")
+	fmt.Fprintf(w, "pool_connected_miners %d\n", atomic.LoadInt64(&m.connected))
+
+	fmt.Fprintln(w, "# HELP pool_share_submit_latency_seconds Time between a share submission and its validation result")
+	fmt.Fprintln(w, "# TYPE pool_share_submit_latency_seconds histogram")
+	for i, bucket := range latencyBuckets {
+		fmt.Fprintf(w, "pool_share_submit_latency_seconds_bucket{le=\"%g\"} %d\n", bucket, m.submitLatencyBuckets[i])
+	}
+	fmt.Fprintf(w, "pool_share_submit_latency_seconds_bucket{le=\"+Inf\"} %d\n", m.submitLatencyCount)
+	fmt.Fprintf(w, "pool_share_submit_latency_seconds_sum %g\n", m.submitLatencySum)
+	fmt.Fprintf(w, "pool_share_submit_latency_seconds_count %d\n", m.submitLatencyCount)
+}
+
+// metricsSink adapts metrics to the eventSink interface so the stratum
+// server can publish through the same eventBus as every other sink.
+type metricsSink struct {
+	m *metrics
+}
+
+func (s *metricsSink) Publish(event interface{}) {
+	switch e := event.(type) {
+	case ShareAccepted:
+		s.m.incShare("accepted", e.Login)
+		s.m.setDiff(e.Login, e.Diff)
+		if e.Latency > 0 {
+			s.m.observeSubmitLatency(e.Latency.Seconds())
+		}
+	case ShareRejected:
+		s.m.incShare("rejected", e.Login)
+		if e.Latency > 0 {
+			s.m.observeSubmitLatency(e.Latency.Seconds())
+		}
+	case BlockFound:
+		s.m.incBlock()
+	case MinerConnected:
+		s.m.minerConnected()
+	case MinerDisconnected:
+		s.m.minerDisconnected()
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// extranonceCounter hands out a unique extranonce1 to every NiceHash-style
+// session, server-wide, so upstream share submissions never collide.
+var extranonceCounter uint32
+
+// nextExtranonce1 returns the next 4-byte extranonce1 as a hex string.
+func nextExtranonce1() string {
+	n := atomic.AddUint32(&extranonceCounter, 1)
+	return fmt.Sprintf("%08x", n)
+}
+
+// niceHashRequest is the stratum v1 frame shape used by ASICs and generic
+// stratum clients: positional array params, rather than the grin-native
+// object params stratumRequest expects.
+type niceHashRequest struct {
+	ID     interface{}   `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+type niceHashResponse struct {
+	ID     interface{}   `json:"id"`
+	Result interface{}   `json:"result,omitempty"`
+	Error  interface{}   `json:"error"`
+	Method string        `json:"method,omitempty"`
+	Params []interface{} `json:"params,omitempty"`
+}
+
+// handleNiceHashConn speaks the mining.subscribe / mining.extranonce.subscribe
+// / mining.authorize / mining.submit handshake that ASICs and generic stratum
+// clients expect, translating it to/from the grin node's native stratum
+// JSON-RPC so the rest of the pool (upstream dialing, vardiff, policy,
+// events) is unaware a client is using a different dialect. The other half
+// of the translation, upstream job pushes and submit results, is handled by
+// writeToMiner/translateUpstreamToNiceHash as those messages arrive
+// asynchronously on the upstream connection rather than on this read loop.
+func (ss *stratumServer) handleNiceHashConn(ctx context.Context, conn net.Conn, session *minerSession, uc *upstreamConn) {
+	extranonce1 := nextExtranonce1()
+
+	reader := bufio.NewReaderSize(conn, maxLineSize)
+	ip := ipOf(conn.RemoteAddr())
+
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			log.Warning(conn.RemoteAddr(), " sent an oversized frame, dropping it")
+			ss.policy.recordMalformed(ip)
+			if ss.policy.isBanned(ip) {
+				return
+			}
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var req niceHashRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			ss.policy.recordMalformed(ip)
+			if ss.policy.isBanned(ip) {
+				return
+			}
+			continue
+		}
+
+		switch req.Method {
+		case "mining.subscribe":
+			writeNice(conn, session, niceHashResponse{
+				ID: req.ID,
+				Result: []interface{}{
+					[]interface{}{
+						[]string{"mining.set_difficulty", extranonce1},
+						[]string{"mining.notify", extranonce1},
+					},
+					extranonce1,
+					4,
+				},
+			})
+
+		case "mining.extranonce.subscribe":
+			writeNice(conn, session, niceHashResponse{ID: req.ID, Result: true})
+
+		case "mining.authorize":
+			login, _ := paramString(req.Params, 0)
+			pass, _ := paramString(req.Params, 1)
+			login = strings.TrimSpace(login)
+			pass = strings.TrimSpace(pass)
+
+			switch ss.db.verifyMiner(login, pass) {
+			case wrongPassword:
+				ss.events.Publish(LoginFailed{IP: ip, Login: login, Ts: time.Now()})
+				writeNice(conn, session, niceHashResponse{ID: req.ID, Result: false, Error: "login incorrect"})
+				continue
+			case noPassword:
+				ss.db.registerMiner(login, pass, "")
+			case correctPassword:
+			}
+
+			session.login = login
+			session.agent = "NiceHash"
+
+			loginReq := &stratumRequest{
+				ID:      "0",
+				JsonRpc: "2.0",
+				Method:  "login",
+				Params: map[string]interface{}{
+					"login": login,
+					"pass":  pass,
+					"agent": session.agent,
+				},
+			}
+			_ = uc.get().enc.Encode(loginReq)
+
+			if ss.conf.Vardiff.Enabled {
+				session.vardiff = newVardiffTracker(ss.conf)
+				go runVardiffRetarget(ctx, conn, uc, session, ss.conf)
+			}
+
+			writeNice(conn, session, niceHashResponse{ID: req.ID, Result: true})
+			writeNice(conn, session, niceHashResponse{
+				Method: "mining.set_difficulty",
+				Params: []interface{}{session.diff()},
+			})
+
+		case "mining.submit":
+			ss.policy.checkLimit(ip)
+			ss.policy.recordSubmit(ip)
+			upstreamID := fmt.Sprint(req.ID)
+			session.markSubmitSent(upstreamID)
+
+			// The upstream's response to this submit arrives later, on the
+			// async callback wired up in connectUpstream, and is matched
+			// back to req.ID there so the miner learns whether its share
+			// actually validated instead of an eager, unconditional true.
+			submitReq := &stratumRequest{
+				ID:      upstreamID,
+				JsonRpc: "2.0",
+				Method:  "submit",
+				Params: map[string]interface{}{
+					"login":       session.login,
+					"extranonce1": extranonce1,
+					"params":      req.Params,
+				},
+			}
+			_ = uc.get().enc.Encode(submitReq)
+
+		default:
+			log.Warning(conn.RemoteAddr(), " sent unsupported nicehash method ", req.Method)
+			writeNice(conn, session, niceHashResponse{ID: req.ID, Result: nil, Error: "unsupported method"})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// writeNice encodes a single NiceHash-dialect frame to conn, serialized
+// against every other writer of this session's connection (see
+// minerSession.writeMu).
+func writeNice(conn net.Conn, session *minerSession, resp niceHashResponse) {
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Error(err)
+	}
+}
+
+// translateUpstreamToNiceHash renders one grin-native upstream message as
+// its NiceHash-dialect equivalent and writes it to conn. The caller
+// (writeToMiner) already holds session.writeMu, so this writes directly
+// rather than going through writeNice.
+//
+// The node's own job-template wire shape isn't visible from this package,
+// so the "job" translation below assumes the conventional grin stratum
+// fields (job_id, pre_pow, height, difficulty); unknown/missing fields are
+// simply omitted rather than causing a failure.
+func translateUpstreamToNiceHash(conn net.Conn, res *stratumResponse) {
+	switch res.Method {
+	case "job":
+		result, _ := res.Result.(map[string]interface{})
+
+		_ = json.NewEncoder(conn).Encode(niceHashResponse{
+			Method: "mining.notify",
+			Params: []interface{}{
+				result["job_id"],
+				result["pre_pow"],
+				result["height"],
+				true,
+			},
+		})
+
+		if diff, ok := result["difficulty"]; ok {
+			_ = json.NewEncoder(conn).Encode(niceHashResponse{
+				Method: "mining.set_difficulty",
+				Params: []interface{}{diff},
+			})
+		}
+
+	case "submit":
+		_ = json.NewEncoder(conn).Encode(niceHashResponse{
+			ID:     res.ID,
+			Result: res.Error == nil,
+			Error:  niceHashErrorPayload(res.Error),
+		})
+
+	default:
+		// status acks and other grin-native housekeeping methods have no
+		// NiceHash-dialect equivalent and the miner doesn't need them.
+	}
+}
+
+func niceHashErrorPayload(err map[string]interface{}) interface{} {
+	if err == nil {
+		return nil
+	}
+	return err
+}
+
+// paramString reads params[i] as a string, if present.
+func paramString(params []interface{}, i int) (string, bool) {
+	if i >= len(params) {
+		return "", false
+	}
+	s, ok := params[i].(string)
+	return s, ok
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// grinBlockReward is the coinbase value of a grin block. It doesn't yet
+// track halving, but the network is young enough that this is the reward
+// for the foreseeable future.
+const grinBlockReward = 60.0
+
+// shareEntry is one entry popped off the shares:window sorted set.
+type shareEntry struct {
+	Login string
+	Diff  int64
+	Ts    time.Time
+}
+
+// payout is one miner's share of a found block's reward.
+type payout struct {
+	ID        string
+	Login     string
+	Amount    float64
+	Height    int64
+	BlockHash string
+	Status    string // "pending", "paid", "failed"
+	CreatedAt time.Time
+	PaidAt    time.Time
+}
+
+// pplnsPayer computes PPLNS (pay-per-last-N-shares) payouts when a block is
+// found and periodically drains the pending payout queue through the
+// wallet's owner API.
+type pplnsPayer struct {
+	db     *database
+	conf   *config
+	wallet *walletClient
+}
+
+func newPPLNSPayer(db *database, conf *config) *pplnsPayer {
+	return &pplnsPayer{
+		db:     db,
+		conf:   conf,
+		wallet: newWalletClient(conf),
+	}
+}
+
+// onBlockFound walks shares:window backward until the summed difficulty
+// covers conf.Payer.N * diff, splits the reward proportionally across the
+// contributing logins via splitReward, and enqueues one pending payout
+// record per miner. diff is the network difficulty the block was found at,
+// as last reported by the upstream node's status RPC.
+func (p *pplnsPayer) onBlockFound(blockHash string, height, diff int64) {
+	shares, err := p.db.pplnsShares(p.conf.Payer.N * diff)
+	if err != nil {
+		log.Error("pplns: reading share window: ", err)
+		return
+	}
+
+	reward := grinBlockReward * (1 - p.conf.Payer.Fee)
+	payouts := splitReward(shares, reward)
+	if len(payouts) == 0 {
+		log.Warning("pplns: no shares in window for block ", blockHash)
+		return
+	}
+
+	for _, po := range payouts {
+		if err := p.db.putPayout(po.Login, po.Amount, height, blockHash); err != nil {
+			log.Error("pplns: enqueue payout for ", po.Login, ": ", err)
+		}
+	}
+
+	log.Warning("pplns: queued payouts for block ", blockHash, " across ", len(payouts), " miners")
+}
+
+// splitReward divides reward proportionally across the logins present in
+// shares, weighted by each login's summed difficulty. Logins are returned
+// sorted for deterministic ordering. It returns nil if shares is empty.
+func splitReward(shares []shareEntry, reward float64) []payout {
+	totals := make(map[string]int64)
+	var total int64
+	for _, s := range shares {
+		totals[s.Login] += s.Diff
+		total += s.Diff
+	}
+	if total == 0 {
+		return nil
+	}
+
+	logins := make([]string, 0, len(totals))
+	for login := range totals {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+
+	payouts := make([]payout, 0, len(logins))
+	for _, login := range logins {
+		amount := reward * float64(totals[login]) / float64(total)
+		payouts = append(payouts, payout{Login: login, Amount: amount})
+	}
+	return payouts
+}
+
+// runSchedule drains the pending payout queue every conf.Payer.Time,
+// sending each through the wallet's owner API and marking the record
+// paid or failed.
+func (p *pplnsPayer) runSchedule() {
+	interval, err := time.ParseDuration(p.conf.Payer.Time)
+	if err != nil {
+		log.Error("pplns: invalid payer.time ", p.conf.Payer.Time, ": ", err)
+		return
+	}
+
+	ch := time.Tick(interval)
+	for range ch {
+		pending, err := p.db.pendingPayouts()
+		if err != nil {
+			log.Error("pplns: listing pending payouts: ", err)
+			continue
+		}
+
+		for _, pay := range pending {
+			txid, err := p.wallet.send(pay.Login, pay.Amount)
+			if err != nil {
+				log.Error("pplns: paying ", pay.Login, ": ", err)
+				if err := p.db.markPayoutFailed(pay.ID); err != nil {
+					log.Error("pplns: marking payout failed: ", err)
+				}
+				continue
+			}
+
+			if err := p.db.markPayoutPaid(pay.ID, txid); err != nil {
+				log.Error("pplns: marking payout paid: ", err)
+				continue
+			}
+			log.Info("pplns: paid ", pay.Amount, " to ", pay.Login, " (", txid, ")")
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSplitRewardProportional(t *testing.T) {
+	now := time.Now()
+	shares := []shareEntry{
+		{Login: "alice", Diff: 300, Ts: now},
+		{Login: "bob", Diff: 100, Ts: now},
+	}
+
+	payouts := splitReward(shares, 40.0)
+	if len(payouts) != 2 {
+		t.Fatalf("expected 2 payouts, got %d", len(payouts))
+	}
+
+	if payouts[0].Login != "alice" || payouts[0].Amount != 30.0 {
+		t.Fatalf("expected alice to get 30.0, got %+v", payouts[0])
+	}
+	if payouts[1].Login != "bob" || payouts[1].Amount != 10.0 {
+		t.Fatalf("expected bob to get 10.0, got %+v", payouts[1])
+	}
+}
+
+func TestSplitRewardNoShares(t *testing.T) {
+	if payouts := splitReward(nil, 40.0); payouts != nil {
+		t.Fatalf("expected nil payouts for an empty share window, got %+v", payouts)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// maxLineSize bounds how large a single stratum frame is allowed to be
+// before the connection is treated as abusive.
+const maxLineSize = 10 * 1024
+
+// pruneInterval controls how often stale per-IP state is swept out of the
+// policy manager's maps, so an IP that stops sending traffic doesn't sit
+// there for the life of the process.
+const pruneInterval = time.Minute
+
+// ipStats holds the sliding-window timestamps behind a single remote IP's
+// malformed-frame and share-validity counters. Every slice is trimmed to
+// policy.banning.window on each record, so a burst that ages out stops
+// counting toward a ban.
+type ipStats struct {
+	malformed []time.Time
+	submits   []time.Time
+	invalid   []time.Time
+}
+
+// policyManager enforces the banning and rate-limit policy described by
+// conf.Policy. It is shared by every connection the stratum server accepts.
+type policyManager struct {
+	mu      sync.Mutex
+	conf    *config
+	stats   map[string]*ipStats
+	bans    map[string]time.Time
+	submits map[string][]time.Time
+}
+
+func newPolicyManager(conf *config) *policyManager {
+	return &policyManager{
+		conf:    conf,
+		stats:   make(map[string]*ipStats),
+		bans:    make(map[string]time.Time),
+		submits: make(map[string][]time.Time),
+	}
+}
+
+// ipOf extracts the bare IP from a net.Addr, dropping the port.
+func ipOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// isBanned reports whether ip is currently serving a ban, expiring the ban
+// if its timeout has passed.
+func (pm *policyManager) isBanned(ip string) bool {
+	if !pm.conf.Policy.Banning.Enabled {
+		return false
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	until, ok := pm.bans[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(pm.bans, ip)
+		return false
+	}
+	return true
+}
+
+// recordMalformed counts a malformed JSON frame from ip within the
+// configured sliding window and bans it once that count crosses
+// policy.banning.malformedLimit.
+func (pm *policyManager) recordMalformed(ip string) {
+	if !pm.conf.Policy.Banning.Enabled {
+		return
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	st := pm.statsFor(ip)
+	st.malformed = append(trimBefore(st.malformed, pm.banCutoff()), time.Now())
+	if int64(len(st.malformed)) >= pm.conf.Policy.Banning.MalformedLimit {
+		pm.banLocked(ip)
+	}
+}
+
+// recordSubmit counts a share submission from ip as soon as it's received
+// from the miner, independent of whether the upstream has validated it
+// yet - a miner pipelining submits faster than the upstream can answer
+// must not be able to dodge the limiter simply by not waiting for
+// responses.
+func (pm *policyManager) recordSubmit(ip string) {
+	if !pm.conf.Policy.Banning.Enabled {
+		return
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	st := pm.statsFor(ip)
+	st.submits = append(trimBefore(st.submits, pm.banCutoff()), time.Now())
+	pm.checkInvalidPercentLocked(ip, st)
+}
+
+// recordInvalid marks the most recent submit from ip as invalid once the
+// upstream's async response comes back, and re-checks the invalid-percent
+// ban threshold.
+func (pm *policyManager) recordInvalid(ip string) {
+	if !pm.conf.Policy.Banning.Enabled {
+		return
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	st := pm.statsFor(ip)
+	st.invalid = append(trimBefore(st.invalid, pm.banCutoff()), time.Now())
+	pm.checkInvalidPercentLocked(ip, st)
+}
+
+// checkInvalidPercentLocked must be called with pm.mu held. It bans ip once
+// enough submits have been seen (policy.banning.checkThreshold) and their
+// invalid rate crosses policy.banning.invalidPercent.
+func (pm *policyManager) checkInvalidPercentLocked(ip string, st *ipStats) {
+	cutoff := pm.banCutoff()
+	st.submits = trimBefore(st.submits, cutoff)
+	st.invalid = trimBefore(st.invalid, cutoff)
+
+	if int64(len(st.submits)) < pm.conf.Policy.Banning.CheckThreshold {
+		return
+	}
+
+	invalidPercent := float64(len(st.invalid)) / float64(len(st.submits)) * 100
+	if invalidPercent >= pm.conf.Policy.Banning.InvalidPercent {
+		pm.banLocked(ip)
+	}
+}
+
+// checkLimit enforces policy.limits: at most policy.limits.limit share
+// submissions within policy.limits.grace seconds, tolerating an extra
+// policy.limits.limitJump submissions before the IP is banned outright.
+// Like recordSubmit, this must run as soon as the submit is received, not
+// once the upstream gets around to answering it.
+func (pm *policyManager) checkLimit(ip string) {
+	lim := pm.conf.Policy.Limits
+	if !lim.Enabled {
+		return
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	cutoff := time.Now().Add(-time.Duration(lim.Grace) * time.Second)
+	times := append(trimBefore(pm.submits[ip], cutoff), time.Now())
+	pm.submits[ip] = times
+
+	if int64(len(times)) > lim.Limit+lim.LimitJump {
+		pm.banLocked(ip)
+	}
+}
+
+func (pm *policyManager) statsFor(ip string) *ipStats {
+	st, ok := pm.stats[ip]
+	if !ok {
+		st = &ipStats{}
+		pm.stats[ip] = st
+	}
+	return st
+}
+
+// banCutoff returns the start of the sliding window used by the malformed
+// and invalid-percent counters.
+func (pm *policyManager) banCutoff() time.Time {
+	return time.Now().Add(-time.Duration(pm.conf.Policy.Banning.Window) * time.Second)
+}
+
+// banLocked must be called with pm.mu held. It records the ban, drops the
+// per-IP counters and hands ip to applyFirewallBan, which adds it to the
+// ipset "pool-banned" set whenever the ipset tool is on PATH. There is no
+// config switch for that step, and the ipset entry is not removed when the
+// in-memory ban expires.
+func (pm *policyManager) banLocked(ip string) {
+	timeout := time.Duration(pm.conf.Policy.Banning.Timeout) * time.Second
+	pm.bans[ip] = time.Now().Add(timeout)
+	delete(pm.stats, ip)
+	delete(pm.submits, ip)
+
+	log.Warning(ip, " banned for ", timeout, " for violating pool policy")
+	applyFirewallBan(ip)
+}
+
+// pruneLoop periodically sweeps expired bans and per-IP state whose
+// sliding window has aged out entirely, so an IP that never crosses a ban
+// threshold doesn't grow pm.stats/pm.submits forever. It runs for the
+// lifetime of the stratum server.
+func (pm *policyManager) pruneLoop(interval time.Duration) {
+	ch := time.Tick(interval)
+	for range ch {
+		pm.prune()
+	}
+}
+
+func (pm *policyManager) prune() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	now := time.Now()
+	banCutoff := pm.banCutoff()
+	for ip, st := range pm.stats {
+		st.malformed = trimBefore(st.malformed, banCutoff)
+		st.submits = trimBefore(st.submits, banCutoff)
+		st.invalid = trimBefore(st.invalid, banCutoff)
+		if len(st.malformed) == 0 && len(st.submits) == 0 && len(st.invalid) == 0 {
+			delete(pm.stats, ip)
+		}
+	}
+
+	limitCutoff := now.Add(-time.Duration(pm.conf.Policy.Limits.Grace) * time.Second)
+	for ip, times := range pm.submits {
+		times = trimBefore(times, limitCutoff)
+		if len(times) == 0 {
+			delete(pm.submits, ip)
+		} else {
+			pm.submits[ip] = times
+		}
+	}
+
+	for ip, until := range pm.bans {
+		if now.After(until) {
+			delete(pm.bans, ip)
+		}
+	}
+}
+
+// trimBefore drops every timestamp in times that falls before cutoff,
+// assuming times is sorted ascending (as append-only usage guarantees).
+func trimBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// applyFirewallBan pushes ip into the system ipset, if one is present, so
+// the kernel drops the connection instead of us having to keep accepting
+// and closing it. Absence of ipset is not an error - the in-memory ban
+// still protects the pool, this is just defense in depth.
+func applyFirewallBan(ip string) {
+	if _, err := exec.LookPath("ipset"); err != nil {
+		return
+	}
+
+	if err := exec.Command("ipset", "add", "pool-banned", ip).Run(); err != nil {
+		log.Error("ipset add ", ip, ": ", err)
+	}
+}
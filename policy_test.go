@@ -0,0 +1,127 @@
+package main
+
+import "testing"
+
+func testPolicyConfig() *config {
+	conf := &config{}
+	conf.Policy.Banning.Enabled = true
+	conf.Policy.Banning.Timeout = 60
+	conf.Policy.Banning.Window = 60
+	conf.Policy.Banning.MalformedLimit = 3
+	conf.Policy.Banning.CheckThreshold = 4
+	conf.Policy.Banning.InvalidPercent = 50
+	conf.Policy.Limits.Enabled = true
+	conf.Policy.Limits.Limit = 5
+	conf.Policy.Limits.Grace = 10
+	conf.Policy.Limits.LimitJump = 2
+	return conf
+}
+
+func TestPolicyManagerBansOnMalformedLimit(t *testing.T) {
+	pm := newPolicyManager(testPolicyConfig())
+
+	for i := 0; i < 2; i++ {
+		pm.recordMalformed("1.2.3.4")
+	}
+	if pm.isBanned("1.2.3.4") {
+		t.Fatal("should not be banned before crossing malformedLimit")
+	}
+
+	pm.recordMalformed("1.2.3.4")
+	if !pm.isBanned("1.2.3.4") {
+		t.Fatal("expected a ban once malformedLimit is crossed")
+	}
+}
+
+func TestPolicyManagerBansOnInvalidPercent(t *testing.T) {
+	pm := newPolicyManager(testPolicyConfig())
+	ip := "1.2.3.4"
+
+	// 3 valid submits: below checkThreshold, no ban check should trigger yet.
+	pm.recordSubmit(ip)
+	pm.recordSubmit(ip)
+	pm.recordSubmit(ip)
+	if pm.isBanned(ip) {
+		t.Fatal("should not be banned below checkThreshold")
+	}
+
+	// 4th submit crosses checkThreshold; no invalids recorded yet, so still
+	// under invalidPercent.
+	pm.recordSubmit(ip)
+	if pm.isBanned(ip) {
+		t.Fatal("should not be banned with 0% invalid")
+	}
+
+	// Recording invalids for 2 of the 4 submits crosses the 50% threshold.
+	pm.recordInvalid(ip)
+	pm.recordInvalid(ip)
+	if !pm.isBanned(ip) {
+		t.Fatal("expected a ban once invalidPercent is crossed")
+	}
+}
+
+func TestPolicyManagerCheckLimitBansOnBurst(t *testing.T) {
+	pm := newPolicyManager(testPolicyConfig())
+	ip := "1.2.3.4"
+
+	// limit=5, limitJump=2: the 8th submit within the grace window bans.
+	for i := 0; i < 7; i++ {
+		pm.checkLimit(ip)
+	}
+	if pm.isBanned(ip) {
+		t.Fatal("should not be banned at exactly limit+limitJump submissions")
+	}
+
+	pm.checkLimit(ip)
+	if !pm.isBanned(ip) {
+		t.Fatal("expected a ban once submissions exceed limit+limitJump")
+	}
+}
+
+func TestPolicyManagerDisabledNeverBans(t *testing.T) {
+	conf := testPolicyConfig()
+	conf.Policy.Banning.Enabled = false
+	conf.Policy.Limits.Enabled = false
+	pm := newPolicyManager(conf)
+	ip := "1.2.3.4"
+
+	for i := 0; i < 100; i++ {
+		pm.recordMalformed(ip)
+		pm.checkLimit(ip)
+	}
+	if pm.isBanned(ip) {
+		t.Fatal("policy checks should be no-ops when disabled")
+	}
+}
+
+func TestPolicyManagerPruneDropsExpiredBan(t *testing.T) {
+	pm := newPolicyManager(testPolicyConfig())
+	ip := "1.2.3.4"
+
+	pm.mu.Lock()
+	pm.bans[ip] = pm.banCutoff() // already expired
+	pm.mu.Unlock()
+
+	pm.prune()
+
+	if pm.isBanned(ip) {
+		t.Fatal("expected prune to drop the expired ban")
+	}
+}
+
+func TestTrimBeforeDropsOnlyExpired(t *testing.T) {
+	conf := testPolicyConfig()
+	pm := newPolicyManager(conf)
+	ip := "1.2.3.4"
+
+	pm.recordSubmit(ip)
+	pm.mu.Lock()
+	before := len(pm.stats[ip].submits)
+	pm.stats[ip].submits = trimBefore(pm.stats[ip].submits, pm.banCutoff())
+	after := len(pm.stats[ip].submits)
+	pm.mu.Unlock()
+
+	if before != 1 || after != 1 {
+		t.Fatalf("expected a freshly recorded submit to survive trimming, got before=%d after=%d", before, after)
+	}
+}
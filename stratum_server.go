@@ -2,20 +2,37 @@ package main
 
 // http rpc server
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"math/rand"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
+// dialBackoffMin/dialBackoffMax bound the sleep connectUpstream takes
+// between failed dial attempts, so a pool with every upstream down backs
+// off instead of busy-spinning a CPU core redialing in a tight loop.
+const (
+	dialBackoffMin = 250 * time.Millisecond
+	dialBackoffMax = 5 * time.Second
+)
+
 type stratumServer struct {
-	db   *database
-	ln   net.Listener
-	conf *config
+	db        *database
+	conf      *config
+	upstreams *upstreamManager
+	policy    *policyManager
+	events    *eventBus
+	payer     *pplnsPayer
 }
 
 type stratumRequest struct {
@@ -37,14 +54,68 @@ type minerSession struct {
 	login      string
 	agent      string
 	difficulty int64
+	niceHash   bool
 	ctx        context.Context
+	vardiff    *vardiffTracker
+
+	// writeMu serializes writes to the miner's conn: the upstream-callback
+	// goroutine, the vardiff retarget goroutine and (for NiceHash sessions)
+	// the translation layer all write to the same socket.
+	writeMu sync.Mutex
+
+	// submitMu guards submitAt, which is keyed by the upstream request id
+	// of each in-flight submit rather than a single timestamp, since a
+	// miner may pipeline a second submit before the upstream answers the
+	// first.
+	submitMu sync.Mutex
+	submitAt map[string]time.Time
 }
 
 func (ms *minerSession) hasNotLoggedIn() bool {
 	return ms.login == ""
 }
 
-func (ms *minerSession) handleMethod(res *stratumResponse, db *database) {
+// diff and setDiff give synchronized access to difficulty, which is read
+// from the upstream-callback goroutine and written from the vardiff
+// retarget goroutine for the lifetime of a session.
+func (ms *minerSession) diff() int64 {
+	return atomic.LoadInt64(&ms.difficulty)
+}
+
+func (ms *minerSession) setDiff(d int64) {
+	atomic.StoreInt64(&ms.difficulty, d)
+}
+
+// markSubmitSent records that the submit request identified by id was just
+// forwarded to the upstream, so the matching async response can report how
+// long validation took. id is the upstream request id, not the local
+// client's - it must be the same id takeSubmitLatency is later called with.
+func (ms *minerSession) markSubmitSent(id string) {
+	ms.submitMu.Lock()
+	if ms.submitAt == nil {
+		ms.submitAt = make(map[string]time.Time)
+	}
+	ms.submitAt[id] = time.Now()
+	ms.submitMu.Unlock()
+}
+
+// takeSubmitLatency returns the elapsed time since markSubmitSent was
+// called for id, consuming the entry so a later response for an unrelated
+// submit doesn't see a stale timestamp. It returns false if id has no
+// outstanding submit, e.g. a duplicate or unexpected response.
+func (ms *minerSession) takeSubmitLatency(id string) (time.Duration, bool) {
+	ms.submitMu.Lock()
+	defer ms.submitMu.Unlock()
+
+	sentAt, ok := ms.submitAt[id]
+	if !ok {
+		return 0, false
+	}
+	delete(ms.submitAt, id)
+	return time.Since(sentAt), true
+}
+
+func (ms *minerSession) handleMethod(res *stratumResponse, db *database, events *eventBus, payer *pplnsPayer, upstreams *upstreamManager) {
 	switch res.Method {
 	case "status":
 		if ms.login == "" {
@@ -52,29 +123,51 @@ func (ms *minerSession) handleMethod(res *stratumResponse, db *database) {
 			break
 		}
 		result, _ := res.Result.(map[string]interface{})
-		db.setMinerAgentStatus(ms.login, ms.agent, ms.difficulty, result)
+		db.setMinerAgentStatus(ms.login, ms.agent, ms.diff(), result)
+
+		if netDiff, ok := result["difficulty"].(float64); ok && netDiff > 0 {
+			upstreams.setNetDiff(int64(netDiff))
+		}
 
 		break
 	case "submit":
+		latency, _ := ms.takeSubmitLatency(res.ID)
 		if res.Error != nil {
 			log.Warning(ms.login, "'s share has err: ", res.Error)
+			events.Publish(ShareRejected{Login: ms.login, Reason: fmt.Sprint(res.Error), Latency: latency, Ts: time.Now()})
 			break
 		}
 		detail, ok := res.Result.(string)
 		log.Info(ms.login, " has submit a ", detail, " share")
 		if ok {
-			db.putShare(ms.login, ms.agent, ms.difficulty)
+			diff := ms.diff()
+			db.putShare(ms.login, ms.agent, diff)
+			db.pushPPLNSShare(ms.login, diff)
+			events.Publish(ShareAccepted{Login: ms.login, Agent: ms.agent, Diff: diff, Latency: latency, Ts: time.Now()})
+			if ms.vardiff != nil {
+				ms.vardiff.recordShare()
+			}
 			if strings.Contains(detail, "block") {
 				blockHash := strings.Trim(detail, "block - ")
 				db.putBlockHash(blockHash)
 				log.Warning("block ", blockHash, " has been found by ", ms.login)
+				events.Publish(BlockFound{Hash: blockHash, Login: ms.login, Diff: diff, Ts: time.Now()})
+
+				netDiff := upstreams.getNetDiff()
+				if netDiff <= 0 {
+					log.Warning("pplns: no network difficulty observed yet, falling back to configured upstream diff")
+					netDiff = int64(payer.conf.Upstreams[0].Diff)
+				}
+				// height isn't available from the submit response alone;
+				// the payout record is keyed primarily by blockHash.
+				payer.onBlockFound(blockHash, 0, netDiff)
 			}
 		}
 		break
 	}
 }
 
-func callStatusPerInterval(ctx context.Context, nc *nodeClient) {
+func callStatusPerInterval(ctx context.Context, uc *upstreamConn) {
 	statusReq := &stratumRequest{
 		ID:      "0",
 		JsonRpc: "2.0",
@@ -83,11 +176,12 @@ func callStatusPerInterval(ctx context.Context, nc *nodeClient) {
 	}
 
 	ch := time.Tick(10 * time.Second)
-	enc := json.NewEncoder(nc.c)
 
 	for {
 		select {
 		case <-ch:
+			nc := uc.get()
+			enc := json.NewEncoder(nc.c)
 			err := enc.Encode(statusReq)
 			if err != nil {
 				log.Error(err)
@@ -98,37 +192,203 @@ func callStatusPerInterval(ctx context.Context, nc *nodeClient) {
 	}
 }
 
-func (ss *stratumServer) handleConn(conn net.Conn) {
+// runVardiffRetarget periodically checks the miner's recent share cadence
+// and, when it has drifted outside the configured variance, pushes a new
+// target to both the miner and the upstream node so shares keep validating
+// at the difficulty the miner is actually mining at.
+func runVardiffRetarget(ctx context.Context, conn net.Conn, uc *upstreamConn, session *minerSession, conf *config) {
+	interval := time.Duration(conf.Vardiff.RetargetInterval) * time.Second
+	ch := time.Tick(interval)
+
+	for {
+		select {
+		case <-ch:
+			newDiff, changed := session.vardiff.retarget(session.diff())
+			if !changed {
+				continue
+			}
+
+			session.setDiff(newDiff)
+			retargetReq := &stratumRequest{
+				ID:      "0",
+				JsonRpc: "2.0",
+				Method:  "job",
+				Params: map[string]interface{}{
+					"difficulty": newDiff,
+				},
+			}
+
+			session.writeMu.Lock()
+			if session.niceHash {
+				_ = json.NewEncoder(conn).Encode(niceHashResponse{
+					Method: "mining.set_difficulty",
+					Params: []interface{}{newDiff},
+				})
+			} else if err := json.NewEncoder(conn).Encode(retargetReq); err != nil {
+				log.Error(err)
+			}
+			session.writeMu.Unlock()
+
+			if err := uc.get().enc.Encode(retargetReq); err != nil {
+				log.Error(err)
+			}
+			log.Info(session.login, "'s difficulty retargeted to ", newDiff)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// upstreamConn holds the nodeClient currently backing a miner session. It
+// lets the session reconnect to a new upstream mid-flight, without the
+// miner ever noticing, by swapping the client out from under the
+// connection's read loop and background status pinger.
+type upstreamConn struct {
+	mu     sync.Mutex
+	nc     *nodeClient
+	cancel context.CancelFunc
+}
+
+func (uc *upstreamConn) get() *nodeClient {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	return uc.nc
+}
+
+func (uc *upstreamConn) close() {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	uc.cancel()
+	uc.nc.close()
+}
+
+// writeToMiner forwards an upstream message to the miner's connection.
+// Native sessions get the raw grin-native JSON verbatim, exactly as the
+// upstream sent it. NiceHash sessions never see that dialect at all - res
+// is translated into the stratum v1 frames an ASIC understands instead.
+func writeToMiner(conn net.Conn, session *minerSession, raw json.RawMessage, res *stratumResponse) {
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+
+	if !session.niceHash {
+		if err := json.NewEncoder(conn).Encode(raw); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	translateUpstreamToNiceHash(conn, res)
+}
+
+// connectUpstream dials the upstream manager's current node, rotating
+// through the pool and marking sick nodes as it goes, until one accepts the
+// connection. The new nodeClient is stored in uc with its response handler
+// already wired up, so that miner sessions keep flowing through to conn.
+func (ss *stratumServer) connectUpstream(conn net.Conn, session *minerSession, uc *upstreamConn) {
+	backoff := dialBackoffMin
+	for {
+		node, idx := ss.upstreams.currentNode()
+
+		nc, err := initNodeStratumClient(node)
+		if err != nil {
+			log.Error("dialing upstream ", node.Address, ": ", err)
+			ss.upstreams.markSick(idx)
+
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > dialBackoffMax {
+				backoff = dialBackoffMax
+			}
+			continue
+		}
+		backoff = dialBackoffMin
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go nc.registerHandler(ctx, func(sr json.RawMessage) {
+			var res stratumResponse
+			_ = json.Unmarshal(sr, &res) // suppress the err
+
+			if res.Method == "status" && res.Error != nil {
+				ss.upstreams.markSick(idx)
+				ss.reconnect(conn, session, uc)
+				return
+			}
+
+			if res.Method == "submit" && res.Error != nil {
+				ss.policy.recordInvalid(ipOf(conn.RemoteAddr()))
+			}
+
+			writeToMiner(conn, session, sr, &res)
+
+			session.handleMethod(&res, ss.db, ss.events, ss.payer, ss.upstreams)
+		})
+
+		uc.mu.Lock()
+		uc.nc, uc.cancel = nc, cancel
+		uc.mu.Unlock()
+
+		return
+	}
+}
+
+// reconnect tears down the sick upstream client and transparently dials the
+// next healthy upstream in its place.
+func (ss *stratumServer) reconnect(conn net.Conn, session *minerSession, uc *upstreamConn) {
+	uc.mu.Lock()
+	uc.cancel()
+	uc.nc.close()
+	uc.mu.Unlock()
+
+	ss.connectUpstream(conn, session, uc)
+}
+
+func (ss *stratumServer) handleConn(conn net.Conn, port PortConfig) {
 	log.Info("new conn from ", conn.RemoteAddr())
-	session := &minerSession{difficulty: int64(ss.conf.Node.Diff)}
+
+	difficulty := int64(ss.conf.Upstreams[0].Diff)
+	if port.Difficulty > 0 {
+		difficulty = port.Difficulty
+	}
+	session := &minerSession{difficulty: difficulty, niceHash: port.NiceHash}
 	defer conn.Close()
 	var login string
-	nc := initNodeStratumClient(ss.conf)
+	ip := ipOf(conn.RemoteAddr())
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	ss.events.Publish(MinerConnected{IP: ip, Ts: time.Now()})
+	defer func() {
+		ss.events.Publish(MinerDisconnected{Login: session.login, IP: ip, Ts: time.Now()})
+	}()
 
-	go nc.registerHandler(ctx, func(sr json.RawMessage) {
-		enc := json.NewEncoder(conn)
-		err := enc.Encode(sr)
-		if err != nil {
-			log.Error(err)
-		}
+	uc := &upstreamConn{}
+	ss.connectUpstream(conn, session, uc)
+	defer uc.close()
 
-		// internal record
-		var res stratumResponse
-		_ = json.Unmarshal(sr, &res) // suppress the err
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		session.handleMethod(&res, ss.db)
-	})
-	defer nc.close()
+	if port.NiceHash {
+		ss.handleNiceHashConn(ctx, conn, session, uc)
+		return
+	}
 
-	dec := json.NewDecoder(conn)
+	reader := bufio.NewReaderSize(conn, maxLineSize)
 	for {
 		var jsonRaw json.RawMessage
 		var clientReq stratumRequest
 
-		err := dec.Decode(&jsonRaw)
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			log.Warning(conn.RemoteAddr(), " sent an oversized frame, dropping it")
+			ss.policy.recordMalformed(ip)
+			if ss.policy.isBanned(ip) {
+				return
+			}
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			continue
+		}
 		if err != nil {
 			opErr, ok := err.(*net.OpError)
 			if ok {
@@ -138,15 +398,21 @@ func (ss *stratumServer) handleConn(conn net.Conn) {
 			} else {
 				log.Error(err)
 			}
+			return
 		}
 
-		if len(jsonRaw) == 0 {
+		jsonRaw = line
+
+		if len(bytes.TrimSpace(jsonRaw)) == 0 {
 			return
 		}
 
 		err = json.Unmarshal(jsonRaw, &clientReq)
 		if err != nil {
-			// log.Error(err)
+			ss.policy.recordMalformed(ip)
+			if ss.policy.isBanned(ip) {
+				return
+			}
 			continue
 		}
 
@@ -171,16 +437,19 @@ func (ss *stratumServer) handleConn(conn net.Conn) {
 			switch ss.db.verifyMiner(login, pass) {
 			case wrongPassword:
 				log.Warning(login, " has failed to login")
+				ss.events.Publish(LoginFailed{IP: ip, Login: login, Ts: time.Now()})
 				login = ""
-				_, _ = conn.Write([]byte(`{  
+				session.writeMu.Lock()
+				_, _ = conn.Write([]byte(`{
    "id":"5",
    "jsonrpc":"2.0",
    "method":"login",
-   "error":{  
+   "error":{
       "code":-32500,
       "message":"login incorrect"
    }
 }`))
+				session.writeMu.Unlock()
 
 			case noPassword:
 				ss.db.registerMiner(login, pass, "")
@@ -201,47 +470,108 @@ func (ss *stratumServer) handleConn(conn net.Conn) {
 				}
 			}
 			if requireCallStatus {
-				go callStatusPerInterval(ctx, nc)
+				go callStatusPerInterval(ctx, uc)
+			}
+
+			if ss.conf.Vardiff.Enabled {
+				session.vardiff = newVardiffTracker(ss.conf)
+				go runVardiffRetarget(ctx, conn, uc, session, ss.conf)
 			}
 
 			log.Info(session.login, "'s ", agent, " has logged in")
-			_ = nc.enc.Encode(jsonRaw)
+			_ = uc.get().enc.Encode(jsonRaw)
 
 		default:
 			if session.hasNotLoggedIn() {
 				log.Warning(login, " has not logged in")
 			}
 
-			_ = nc.enc.Encode(jsonRaw)
+			if clientReq.Method == "submit" {
+				ss.policy.checkLimit(ip)
+				ss.policy.recordSubmit(ip)
+				session.markSubmitSent(clientReq.ID)
+			}
+
+			_ = uc.get().enc.Encode(jsonRaw)
 		}
 	}
 }
 
 func initStratumServer(db *database, conf *config) {
-	ip := net.ParseIP(conf.StratumServer.Address)
+	upstreams := newUpstreamManager(conf.Upstreams)
+	go upstreams.probeSick(30 * time.Second)
+
+	sinks := []eventSink{&metricsSink{m: poolMetrics}}
+	if conf.Events.Webhook.Enabled {
+		sinks = append(sinks, newWebhookSink(conf.Events.Webhook.URL))
+	}
+
+	payer := newPPLNSPayer(db, conf)
+	go payer.runSchedule()
+
+	policy := newPolicyManager(conf)
+	go policy.pruneLoop(pruneInterval)
+
+	ss := &stratumServer{
+		db:        db,
+		conf:      conf,
+		upstreams: upstreams,
+		policy:    policy,
+		events:    newEventBus(sinks...),
+		payer:     payer,
+	}
+
+	for _, port := range conf.StratumServer.Ports {
+		ln, err := listenPort(port)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Warning("listening on ", port.Port)
+		go ss.serve(ln, port)
+	}
+
+	select {}
+}
+
+// listenPort binds a TCP listener for port, wrapping it in TLS when
+// port.TLS.Enabled.
+func listenPort(port PortConfig) (net.Listener, error) {
 	addr := &net.TCPAddr{
-		IP:   ip,
-		Port: conf.StratumServer.Port,
+		IP:   net.ParseIP(port.Host),
+		Port: port.Port,
 	}
 	ln, err := net.ListenTCP("tcp", addr)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if !port.TLS.Enabled {
+		return ln, nil
 	}
 
-	log.Warning("listening on ", conf.StratumServer.Port)
-
-	ss := &stratumServer{
-		db:   db,
-		ln:   ln,
-		conf: conf,
+	cert, err := tls.LoadX509KeyPair(port.TLS.Cert, port.TLS.Key)
+	if err != nil {
+		return nil, err
 	}
 
+	return tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}}), nil
+}
+
+// serve accepts connections on ln for the lifetime of the pool, dispatching
+// each to handleConn with the port config it was accepted on.
+func (ss *stratumServer) serve(ln net.Listener, port PortConfig) {
 	for {
-		conn, err := ln.AcceptTCP()
+		conn, err := ln.Accept()
 		if err != nil {
 			log.Error(err)
+			continue
+		}
+
+		if ss.policy.isBanned(ipOf(conn.RemoteAddr())) {
+			conn.Close()
+			continue
 		}
 
-		go ss.handleConn(conn)
+		go ss.handleConn(conn, port)
 	}
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// probeTimeout bounds how long probeUpstream waits for a status reply
+// before giving up on a candidate upstream.
+const probeTimeout = 5 * time.Second
+
+// upstreamManager tracks the pool of configured grin-node upstreams, which
+// one is currently selected and whether each is healthy. It is shared by
+// every miner session so that a single sick upstream doesn't have to be
+// rediscovered per-connection.
+type upstreamManager struct {
+	mu      sync.Mutex
+	nodes   []NodeConfig
+	healthy []bool
+	current int
+
+	// netDiff is the current upstream's network difficulty, refreshed from
+	// its periodic "status" RPC response. PPLNS payouts need this, not a
+	// miner's own share difficulty, to size the share window correctly.
+	netDiff int64
+}
+
+func newUpstreamManager(nodes []NodeConfig) *upstreamManager {
+	healthy := make([]bool, len(nodes))
+	for i := range healthy {
+		healthy[i] = true
+	}
+
+	return &upstreamManager{
+		nodes:   nodes,
+		healthy: healthy,
+	}
+}
+
+// currentNode returns the upstream that should be used right now, and its
+// index.
+func (um *upstreamManager) currentNode() (NodeConfig, int) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	return um.nodes[um.current], um.current
+}
+
+// setNetDiff records the current upstream's network difficulty, as last
+// reported by its status RPC.
+func (um *upstreamManager) setNetDiff(diff int64) {
+	atomic.StoreInt64(&um.netDiff, diff)
+}
+
+// getNetDiff returns the most recently recorded network difficulty, or 0 if
+// none has been seen yet.
+func (um *upstreamManager) getNetDiff() int64 {
+	return atomic.LoadInt64(&um.netDiff)
+}
+
+// markSick flags idx as unhealthy and rotates the current upstream to the
+// next healthy one, if any. It is safe to call from multiple miner sessions
+// concurrently.
+func (um *upstreamManager) markSick(idx int) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if idx < 0 || idx >= len(um.nodes) {
+		return
+	}
+
+	um.healthy[idx] = false
+	log.Warning("upstream ", um.nodes[idx].Address, " marked sick")
+
+	if um.current != idx {
+		return
+	}
+
+	for i := 1; i <= len(um.nodes); i++ {
+		next := (idx + i) % len(um.nodes)
+		if um.healthy[next] {
+			um.current = next
+			log.Warning("rotated to upstream ", um.nodes[next].Address)
+			return
+		}
+	}
+}
+
+// markHealthy restores idx as a candidate upstream without forcing a
+// rotation back onto it; the active upstream keeps serving until it, in
+// turn, goes sick.
+func (um *upstreamManager) markHealthy(idx int) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if idx < 0 || idx >= len(um.nodes) {
+		return
+	}
+
+	if !um.healthy[idx] {
+		log.Info("upstream ", um.nodes[idx].Address, " recovered")
+	}
+	um.healthy[idx] = true
+}
+
+// probeSick periodically pings every unhealthy upstream's status RPC and
+// restores it once it responds again. It runs for the lifetime of the
+// stratum server.
+func (um *upstreamManager) probeSick(interval time.Duration) {
+	ch := time.Tick(interval)
+	for range ch {
+		um.mu.Lock()
+		nodes := make([]NodeConfig, len(um.nodes))
+		copy(nodes, um.nodes)
+		healthy := make([]bool, len(um.healthy))
+		copy(healthy, um.healthy)
+		um.mu.Unlock()
+
+		for idx, node := range nodes {
+			if healthy[idx] {
+				continue
+			}
+			if probeUpstream(node) {
+				um.markHealthy(idx)
+			}
+		}
+	}
+}
+
+// probeUpstream dials the upstream's stratum port and waits for an actual
+// status RPC reply, so a node whose socket accepts connections but whose
+// grin-node is hung is not mistaken for healthy.
+func probeUpstream(node NodeConfig) bool {
+	nc, err := initNodeStratumClient(node)
+	if err != nil {
+		return false
+	}
+	defer nc.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	result := make(chan bool, 1)
+	go nc.registerHandler(ctx, func(sr json.RawMessage) {
+		var res stratumResponse
+		if err := json.Unmarshal(sr, &res); err != nil {
+			return
+		}
+		if res.Method != "status" {
+			return
+		}
+		select {
+		case result <- res.Error == nil:
+		default:
+		}
+	})
+
+	statusReq := &stratumRequest{ID: "0", JsonRpc: "2.0", Method: "status"}
+	if err := nc.enc.Encode(statusReq); err != nil {
+		return false
+	}
+
+	select {
+	case ok := <-result:
+		return ok
+	case <-ctx.Done():
+		return false
+	}
+}
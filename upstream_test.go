@@ -0,0 +1,84 @@
+package main
+
+import "testing"
+
+func testNodes(n int) []NodeConfig {
+	nodes := make([]NodeConfig, n)
+	for i := range nodes {
+		nodes[i] = NodeConfig{Address: string(rune('a' + i))}
+	}
+	return nodes
+}
+
+func TestUpstreamManagerMarkSickRotatesToNextHealthy(t *testing.T) {
+	um := newUpstreamManager(testNodes(3))
+
+	um.markSick(0)
+
+	_, idx := um.currentNode()
+	if idx != 1 {
+		t.Fatalf("expected rotation to index 1, got %d", idx)
+	}
+}
+
+func TestUpstreamManagerMarkSickSkipsOtherSickNodes(t *testing.T) {
+	um := newUpstreamManager(testNodes(3))
+
+	um.markSick(1)
+	um.markSick(0)
+
+	_, idx := um.currentNode()
+	if idx != 2 {
+		t.Fatalf("expected rotation to skip sick index 1 and land on 2, got %d", idx)
+	}
+}
+
+func TestUpstreamManagerMarkSickNonCurrentDoesNotRotate(t *testing.T) {
+	um := newUpstreamManager(testNodes(3))
+
+	um.markSick(2)
+
+	_, idx := um.currentNode()
+	if idx != 0 {
+		t.Fatalf("marking a non-current node sick should not rotate, got %d", idx)
+	}
+}
+
+func TestUpstreamManagerAllSickHoldsCurrent(t *testing.T) {
+	um := newUpstreamManager(testNodes(2))
+
+	um.markSick(0)
+	um.markSick(1)
+
+	_, idx := um.currentNode()
+	// markSick(0) already rotated onto 1; with nothing healthy left after
+	// markSick(1), current stays on 1.
+	if idx != 1 {
+		t.Fatalf("with no healthy upstream left, current should stay put, got %d", idx)
+	}
+}
+
+func TestUpstreamManagerMarkHealthyDoesNotForceRotation(t *testing.T) {
+	um := newUpstreamManager(testNodes(2))
+
+	um.markSick(0)
+	um.markHealthy(0)
+
+	_, idx := um.currentNode()
+	if idx != 1 {
+		t.Fatalf("markHealthy should not rotate back onto the recovered node, got %d", idx)
+	}
+}
+
+func TestUpstreamManagerNetDiff(t *testing.T) {
+	um := newUpstreamManager(testNodes(1))
+
+	if diff := um.getNetDiff(); diff != 0 {
+		t.Fatalf("expected 0 before any status response, got %d", diff)
+	}
+
+	um.setNetDiff(42)
+	if diff := um.getNetDiff(); diff != 42 {
+		t.Fatalf("expected 42, got %d", diff)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// vardiffWindow bounds how many recent shares are used to estimate the
+	// miner's current share rate.
+	vardiffWindow = 30
+	// vardiffMaxStep caps how much a single retarget may change difficulty
+	// by, so a miner's target doesn't jump wildly on a lucky/unlucky streak.
+	vardiffMaxStep = 4.0
+	// vardiffEpsilon is the minimum relative change required before a
+	// retarget is applied, to avoid thrashing the miner's target back and
+	// forth for negligible gains.
+	vardiffEpsilon = 0.05
+)
+
+// vardiffTracker keeps the rolling share history for a single miner session
+// and computes retargeted difficulties so that the miner submits shares
+// roughly every targetTime seconds.
+type vardiffTracker struct {
+	mu         sync.Mutex
+	targetTime float64
+	variance   float64
+	minDiff    int64
+	maxDiff    int64
+	shareTimes []time.Time
+}
+
+func newVardiffTracker(conf *config) *vardiffTracker {
+	return &vardiffTracker{
+		targetTime: float64(conf.Vardiff.TargetTime),
+		variance:   conf.Vardiff.Variance,
+		minDiff:    conf.Vardiff.MinDiff,
+		maxDiff:    conf.Vardiff.MaxDiff,
+	}
+}
+
+// recordShare registers that a share just came in, trimming the window to
+// the last vardiffWindow shares within the last 2 minutes.
+func (vd *vardiffTracker) recordShare() {
+	vd.mu.Lock()
+	defer vd.mu.Unlock()
+
+	now := time.Now()
+	vd.shareTimes = append(vd.shareTimes, now)
+	if len(vd.shareTimes) > vardiffWindow {
+		vd.shareTimes = vd.shareTimes[len(vd.shareTimes)-vardiffWindow:]
+	}
+
+	cutoff := now.Add(-2 * time.Minute)
+	i := 0
+	for i < len(vd.shareTimes) && vd.shareTimes[i].Before(cutoff) {
+		i++
+	}
+	vd.shareTimes = vd.shareTimes[i:]
+}
+
+// retarget returns a new difficulty for curDiff based on the average
+// inter-share time over the current window. The second return value is
+// false when the cadence is still within the configured variance band, or
+// the resulting change is too small to bother applying.
+func (vd *vardiffTracker) retarget(curDiff int64) (int64, bool) {
+	vd.mu.Lock()
+	defer vd.mu.Unlock()
+
+	if len(vd.shareTimes) < 2 {
+		return curDiff, false
+	}
+
+	span := vd.shareTimes[len(vd.shareTimes)-1].Sub(vd.shareTimes[0]).Seconds()
+	avg := span / float64(len(vd.shareTimes)-1)
+	if avg <= 0 {
+		return curDiff, false
+	}
+
+	var factor float64
+	switch {
+	case avg < vd.targetTime/vd.variance:
+		factor = vd.targetTime / avg
+		if factor > vardiffMaxStep {
+			factor = vardiffMaxStep
+		}
+	case avg > vd.targetTime*vd.variance:
+		factor = avg / vd.targetTime
+		if factor > vardiffMaxStep {
+			factor = vardiffMaxStep
+		}
+		factor = 1 / factor
+	default:
+		return curDiff, false
+	}
+
+	newDiff := int64(float64(curDiff) * factor)
+	if newDiff < vd.minDiff {
+		newDiff = vd.minDiff
+	}
+	if newDiff > vd.maxDiff {
+		newDiff = vd.maxDiff
+	}
+	if newDiff == curDiff {
+		return curDiff, false
+	}
+
+	delta := float64(newDiff-curDiff) / float64(curDiff)
+	if delta < 0 {
+		delta = -delta
+	}
+	if delta < vardiffEpsilon {
+		return curDiff, false
+	}
+
+	return newDiff, true
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVardiffTrackerRetargetsUpward(t *testing.T) {
+	vd := &vardiffTracker{
+		targetTime: 10,
+		variance:   1.5,
+		minDiff:    1,
+		maxDiff:    1000000,
+	}
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		vd.shareTimes = append(vd.shareTimes, now.Add(time.Duration(i)*time.Second))
+	}
+
+	newDiff, changed := vd.retarget(1000)
+	if !changed {
+		t.Fatal("expected a retarget when shares arrive far faster than targetTime")
+	}
+	if newDiff <= 1000 {
+		t.Fatalf("expected difficulty to increase for a fast miner, got %d", newDiff)
+	}
+}
+
+func TestVardiffTrackerHoldsWithinVariance(t *testing.T) {
+	vd := &vardiffTracker{
+		targetTime: 10,
+		variance:   1.5,
+		minDiff:    1,
+		maxDiff:    1000000,
+	}
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		vd.shareTimes = append(vd.shareTimes, now.Add(time.Duration(i*10)*time.Second))
+	}
+
+	if _, changed := vd.retarget(1000); changed {
+		t.Fatal("expected no retarget when cadence matches targetTime")
+	}
+}
+
+func TestVardiffTrackerClampsToMaxDiff(t *testing.T) {
+	vd := &vardiffTracker{
+		targetTime: 10,
+		variance:   1.5,
+		minDiff:    1,
+		maxDiff:    1500,
+	}
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		vd.shareTimes = append(vd.shareTimes, now.Add(time.Duration(i)*time.Second))
+	}
+
+	newDiff, changed := vd.retarget(1000)
+	if !changed {
+		t.Fatal("expected a retarget")
+	}
+	if newDiff > 1500 {
+		t.Fatalf("expected difficulty clamped to maxDiff 1500, got %d", newDiff)
+	}
+}
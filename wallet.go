@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// walletClient talks to grin-wallet's owner API to move pool payouts.
+type walletClient struct {
+	url      string
+	authUser string
+	authPass string
+	client   *http.Client
+}
+
+func newWalletClient(conf *config) *walletClient {
+	return &walletClient{
+		url:      fmt.Sprintf("http://%s:%d/v%s/owner", conf.Wallet.Address, conf.Wallet.OwnerAPIPort, conf.Wallet.OwnerAPIVersion),
+		authUser: conf.Wallet.AuthUser,
+		authPass: conf.Wallet.AuthPass,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type walletRPCRequest struct {
+	JsonRpc string                 `json:"jsonrpc"`
+	ID      string                 `json:"id"`
+	Method  string                 `json:"method"`
+	Params  map[string]interface{} `json:"params"`
+}
+
+type walletRPCResponse struct {
+	Result map[string]interface{} `json:"result"`
+	Error  map[string]interface{} `json:"error"`
+}
+
+// send issues an owner-API send_tx call paying amount grin, with login
+// itself as the destination, returning the resulting transaction slate id.
+func (w *walletClient) send(login string, amount float64) (string, error) {
+	req := walletRPCRequest{
+		JsonRpc: "2.0",
+		ID:      "1",
+		Method:  "send_tx",
+		Params: map[string]interface{}{
+			"dest":   login,
+			"amount": amount,
+		},
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	httpReq, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpReq.SetBasicAuth(w.authUser, w.authPass)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var rpcRes walletRPCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcRes); err != nil {
+		return "", err
+	}
+	if rpcRes.Error != nil {
+		return "", fmt.Errorf("wallet rpc error: %v", rpcRes.Error)
+	}
+
+	txid, _ := rpcRes.Result["tx_slate_id"].(string)
+	return txid, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// webhookSink posts every event as JSON to a configured external endpoint,
+// for dashboards or alerting that live outside the pool. A NATS publisher
+// can be added later behind the same eventSink interface without touching
+// the stratum server.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookSink(url string) *webhookSink {
+	return &webhookSink{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (s *webhookSink) Publish(event interface{}) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	go func() {
+		resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Error("webhook publish: ", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}